@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+	"github.com/kalkspace/stroma-streama/broker"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/hraban/opus.v2"
+)
+
+// setupAudio captures the local PortAudio input device, encodes it to Opus
+// and publishes each frame onto stream. It only runs the device while
+// stream has at least one subscriber, same as the original single-client
+// behaviour, just driven by the stream's subscriber count instead of a
+// dedicated "client connected" channel.
+func setupAudio(
+	ctx context.Context,
+	log logrus.FieldLogger,
+	stream *broker.Stream,
+) error {
+	portaudio.Initialize()
+
+	opusEnc, err := opus.NewEncoder(sampleRate, channelCount, opus.AppVoIP)
+	if err != nil {
+		return errors.Wrap(err, "failed setting up encoder")
+	}
+
+	controller := newEncoderController(log, opusEnc, stream)
+	go controller.run(ctx.Done())
+
+	// buffers
+	inBuf := make([]int16, frameSize)
+	encBuf := make([]byte, 1024)
+
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return errors.Wrap(err, "failed to get devices")
+	}
+	var selectedDev *portaudio.DeviceInfo
+	if len(os.Args) > 1 {
+		for _, dev := range devices {
+			log.WithField("name", dev.Name).Debug("dev found")
+			if dev.Name == os.Args[1] {
+				if dev.MaxInputChannels < channelCount {
+					log.WithField("channels", dev.MaxInputChannels).Fatal("Device not suitable for recording")
+				}
+				selectedDev = dev
+			}
+		}
+		if selectedDev == nil {
+			log.WithField("name", os.Args[1]).Fatal("dev not found")
+		}
+	} else {
+		dev, err := portaudio.DefaultInputDevice()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to find default input device")
+		}
+		selectedDev = dev
+	}
+
+	// open mic source
+	params := portaudio.LowLatencyParameters(selectedDev, nil)
+	params.Input.Channels = channelCount
+	params.SampleRate = sampleRate
+	params.FramesPerBuffer = len(inBuf)
+	audioStream, err := portaudio.OpenStream(params, inBuf)
+	if err != nil {
+		return errors.Wrap(err, "failed to open stream")
+	}
+
+	go func() {
+		defer portaudio.Terminate()
+		defer audioStream.Close()
+
+		started := false
+		var sent uint64
+		lastStatsOutput := time.Now()
+
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if stream.SubscriberCount() == 0 {
+				if started {
+					if err := audioStream.Abort(); err != nil {
+						panic(err)
+					}
+					started = false
+				}
+
+				log.WithField("stream", stream.ID).Info("Waiting for subscribers to connect...")
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+
+			if !started {
+				if err := audioStream.Start(); err != nil {
+					panic(err)
+				}
+				started = true
+				log.WithField("stream", stream.ID).Info("Subscriber connected. Starting to stream")
+			}
+
+			if err := audioStream.Read(); err != nil {
+				log.WithField("sent", sent).Info("statistics")
+				log.WithError(err).Fatal("failed to read audio input")
+			}
+
+			// encode to opus
+			encodeTimer := prometheus.NewTimer(encodeLatency.WithLabelValues(stream.ID))
+			encSize, err := opusEnc.Encode(inBuf, encBuf)
+			encodeTimer.ObserveDuration()
+			if err != nil {
+				log.WithField("sent", sent).Info("statistics")
+				log.WithError(err).Fatal("failed to encode audio")
+			}
+			encoderFrameSizeBytes.WithLabelValues(stream.ID).Set(float64(encSize))
+
+			stream.Publish(encBuf[:encSize])
+			sent++
+
+			if time.Since(lastStatsOutput) > time.Second*5 {
+				log.WithField("sent", sent).Info("statistics")
+				lastStatsOutput = time.Now()
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kalkspace/stroma-streama/broker"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	minBitrate  = 16000
+	maxBitrate  = 64000
+	bitrateStep = 8000
+
+	// fractionLost is RTCP's 0-255 scale for the share of packets lost since
+	// the last report; roughly 5% maps to 13/255.
+	fecOnThreshold  = 13
+	fecOffThreshold = 5
+
+	// Consecutive bad/good ticks required before acting, so a single noisy
+	// receiver report can't bounce the bitrate around.
+	hysteresisCount = 3
+
+	bitrateCheckInterval = 2 * time.Second
+)
+
+// bitrateEncoder is the subset of *opus.Encoder that encoderController
+// tunes; factored out so tests can drive the hysteresis logic against a
+// fake encoder instead of the real cgo-backed one.
+type bitrateEncoder interface {
+	SetBitrate(bitrate int) error
+	SetInBandFEC(fec bool) error
+	SetPacketLossPerc(lossPerc int) error
+}
+
+// encoderController adapts opusEnc's bitrate, inband FEC and expected
+// packet-loss percentage to a stream's worst-reported receiver feedback.
+// Since setupAudio runs one encoder for every subscriber of the stream,
+// there is deliberately one shared control loop rather than per-client
+// tuning: it optimizes for whichever listener is struggling most.
+type encoderController struct {
+	log    logrus.FieldLogger
+	enc    bitrateEncoder
+	stream *broker.Stream
+
+	bitrate    int
+	fecOn      bool
+	badStreak  int
+	goodStreak int
+}
+
+func newEncoderController(log logrus.FieldLogger, enc *opus.Encoder, stream *broker.Stream) *encoderController {
+	if err := enc.SetBitrate(maxBitrate); err != nil {
+		log.WithError(err).Warn("failed to set bitrate")
+	}
+	opusBitrateBps.WithLabelValues(stream.ID).Set(maxBitrate)
+	return &encoderController{log: log, enc: enc, stream: stream, bitrate: maxBitrate}
+}
+
+// run polls the stream's worst-case receiver feedback on an interval and
+// adjusts the encoder until done is closed.
+func (c *encoderController) run(done <-chan struct{}) {
+	ticker := time.NewTicker(bitrateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.tick()
+		}
+	}
+}
+
+func (c *encoderController) tick() {
+	feedback := c.stream.WorstFeedback()
+
+	switch {
+	case feedback.FractionLost >= fecOnThreshold:
+		c.badStreak++
+		c.goodStreak = 0
+	case feedback.FractionLost <= fecOffThreshold:
+		c.goodStreak++
+		c.badStreak = 0
+	default:
+		c.badStreak, c.goodStreak = 0, 0
+	}
+
+	switch {
+	case c.badStreak >= hysteresisCount:
+		c.badStreak = 0
+		c.degrade(feedback)
+	case c.goodStreak >= hysteresisCount:
+		c.goodStreak = 0
+		c.recover()
+	}
+}
+
+func (c *encoderController) degrade(feedback broker.ReceiverReport) {
+	if !c.fecOn {
+		c.fecOn = true
+		if err := c.enc.SetInBandFEC(true); err != nil {
+			c.log.WithError(err).Warn("failed to enable inband FEC")
+		}
+	}
+
+	lossPerc := int(feedback.FractionLost) * 100 / 255
+	if err := c.enc.SetPacketLossPerc(lossPerc); err != nil {
+		c.log.WithError(err).Warn("failed to set packet loss percentage")
+	}
+
+	if c.bitrate > minBitrate {
+		c.bitrate -= bitrateStep
+		if c.bitrate < minBitrate {
+			c.bitrate = minBitrate
+		}
+		if err := c.enc.SetBitrate(c.bitrate); err != nil {
+			c.log.WithError(err).Warn("failed to set bitrate")
+		}
+		opusBitrateBps.WithLabelValues(c.stream.ID).Set(float64(c.bitrate))
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"bitrate_bps": c.bitrate,
+		"fec":         c.fecOn,
+		"loss_perc":   lossPerc,
+	}).Info("degraded encoder for sustained loss")
+}
+
+func (c *encoderController) recover() {
+	if c.fecOn {
+		c.fecOn = false
+		if err := c.enc.SetInBandFEC(false); err != nil {
+			c.log.WithError(err).Warn("failed to disable inband FEC")
+		}
+	}
+
+	if c.bitrate < maxBitrate {
+		c.bitrate += bitrateStep
+		if c.bitrate > maxBitrate {
+			c.bitrate = maxBitrate
+		}
+		if err := c.enc.SetBitrate(c.bitrate); err != nil {
+			c.log.WithError(err).Warn("failed to set bitrate")
+		}
+		opusBitrateBps.WithLabelValues(c.stream.ID).Set(float64(c.bitrate))
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"bitrate_bps": c.bitrate,
+		"fec":         c.fecOn,
+	}).Info("recovered encoder after sustained clean reports")
+}
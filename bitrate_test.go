@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/kalkspace/stroma-streama/broker"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeBitrateEncoder records the calls encoderController makes so tests can
+// assert on the resulting bitrate/FEC state without a real opus.Encoder.
+type fakeBitrateEncoder struct {
+	bitrate     int
+	fec         bool
+	lossPerc    int
+	bitrateSets int
+}
+
+func (e *fakeBitrateEncoder) SetBitrate(bitrate int) error {
+	e.bitrate = bitrate
+	e.bitrateSets++
+	return nil
+}
+
+func (e *fakeBitrateEncoder) SetInBandFEC(fec bool) error {
+	e.fec = fec
+	return nil
+}
+
+func (e *fakeBitrateEncoder) SetPacketLossPerc(lossPerc int) error {
+	e.lossPerc = lossPerc
+	return nil
+}
+
+func testController() (*encoderController, *fakeBitrateEncoder, *broker.Subscriber) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	stream := broker.New(log).GetOrCreateStream("test")
+	sub := stream.Subscribe()
+
+	enc := &fakeBitrateEncoder{bitrate: maxBitrate}
+	return &encoderController{log: log, enc: enc, stream: stream, bitrate: maxBitrate}, enc, sub
+}
+
+// reportBadTicks feeds n consecutive reports at/above fecOnThreshold.
+func reportBadTicks(c *encoderController, sub *broker.Subscriber, n int) {
+	for i := 0; i < n; i++ {
+		sub.RecordFeedback(broker.ReceiverReport{FractionLost: fecOnThreshold})
+		c.tick()
+	}
+}
+
+// reportGoodTicks feeds n consecutive reports at/below fecOffThreshold.
+func reportGoodTicks(c *encoderController, sub *broker.Subscriber, n int) {
+	for i := 0; i < n; i++ {
+		sub.RecordFeedback(broker.ReceiverReport{FractionLost: fecOffThreshold})
+		c.tick()
+	}
+}
+
+func TestEncoderController_DoesNotDegradeBeforeHysteresisCount(t *testing.T) {
+	c, enc, sub := testController()
+
+	reportBadTicks(c, sub, hysteresisCount-1)
+
+	if enc.fec {
+		t.Fatal("FEC enabled before hysteresisCount consecutive bad reports")
+	}
+	if enc.bitrateSets != 0 {
+		t.Fatal("bitrate changed before hysteresisCount consecutive bad reports")
+	}
+}
+
+func TestEncoderController_DegradesAtHysteresisCount(t *testing.T) {
+	c, enc, sub := testController()
+
+	reportBadTicks(c, sub, hysteresisCount)
+
+	if !enc.fec {
+		t.Fatal("FEC not enabled after hysteresisCount consecutive bad reports")
+	}
+	if enc.bitrate != maxBitrate-bitrateStep {
+		t.Fatalf("bitrate = %d, want %d", enc.bitrate, maxBitrate-bitrateStep)
+	}
+}
+
+func TestEncoderController_SingleBadReportDoesNotDegrade(t *testing.T) {
+	c, enc, sub := testController()
+
+	sub.RecordFeedback(broker.ReceiverReport{FractionLost: fecOnThreshold})
+	c.tick()
+	sub.RecordFeedback(broker.ReceiverReport{FractionLost: fecOffThreshold})
+	c.tick()
+	sub.RecordFeedback(broker.ReceiverReport{FractionLost: fecOnThreshold})
+	c.tick()
+
+	if enc.fec || enc.bitrateSets != 0 {
+		t.Fatal("a single noisy report changed encoder state; hysteresis streak should have reset")
+	}
+}
+
+func TestEncoderController_RecoversAtHysteresisCountAfterDegrading(t *testing.T) {
+	c, enc, sub := testController()
+
+	reportBadTicks(c, sub, hysteresisCount)
+	degraded := enc.bitrate
+
+	reportGoodTicks(c, sub, hysteresisCount-1)
+	if enc.bitrate != degraded || enc.fec == false {
+		t.Fatal("recovered before hysteresisCount consecutive good reports")
+	}
+
+	sub.RecordFeedback(broker.ReceiverReport{FractionLost: fecOffThreshold})
+	c.tick()
+
+	if enc.fec {
+		t.Fatal("FEC still enabled after hysteresisCount consecutive good reports")
+	}
+	if enc.bitrate != degraded+bitrateStep {
+		t.Fatalf("bitrate = %d, want %d", enc.bitrate, degraded+bitrateStep)
+	}
+}
+
+func TestEncoderController_BitrateClampedToMinAndMax(t *testing.T) {
+	c, enc, sub := testController()
+
+	// Degrade far past the point where bitrate would go below minBitrate.
+	rounds := (maxBitrate-minBitrate)/bitrateStep + 3
+	for i := 0; i < rounds; i++ {
+		reportBadTicks(c, sub, hysteresisCount)
+	}
+	if enc.bitrate != minBitrate {
+		t.Fatalf("bitrate = %d, want clamped to minBitrate %d", enc.bitrate, minBitrate)
+	}
+
+	// Recover far past the point where bitrate would exceed maxBitrate.
+	for i := 0; i < rounds; i++ {
+		reportGoodTicks(c, sub, hysteresisCount)
+	}
+	if enc.bitrate != maxBitrate {
+		t.Fatalf("bitrate = %d, want clamped to maxBitrate %d", enc.bitrate, maxBitrate)
+	}
+}
@@ -0,0 +1,198 @@
+// Package broker lets audio be published into named streams and fanned out
+// to any number of subscribers, so a single process can carry several
+// concurrent broadcasts instead of one global source feeding every client.
+package broker
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Frame is a single encoded Opus payload ready to be written to a track.
+type Frame = []byte
+
+// Subscriber is the handle a WHEP consumer holds on a Stream.
+type Subscriber struct {
+	ID     uint64
+	Frames <-chan Frame
+
+	stream *Stream
+}
+
+// Unsubscribe removes the subscriber from the stream's fanout and closes
+// its Frames channel. It is safe to call more than once.
+func (s *Subscriber) Unsubscribe() {
+	s.stream.unsubscribe(s.ID)
+}
+
+// RecordFeedback reports this subscriber's latest RTCP receiver report so a
+// publisher-side encoder can adapt to it; see Stream.WorstFeedback.
+func (s *Subscriber) RecordFeedback(report ReceiverReport) {
+	s.stream.recordFeedback(s.ID, report)
+}
+
+// ReceiverReport captures the RTCP receiver report fields relevant to
+// bitrate adaptation: fraction of packets lost since the last report, on
+// RTCP's native 0-255 scale, and interarrival jitter in RTP timestamp
+// units.
+type ReceiverReport struct {
+	FractionLost uint8
+	Jitter       uint32
+}
+
+// Stream is a single named broadcast: publishers (local PortAudio input or
+// remote WHIP ingest) feed it encoded Opus frames via Publish, and every
+// subscriber attached via Subscribe receives its own fanout copy.
+type Stream struct {
+	ID  string
+	log logrus.FieldLogger
+
+	mu          sync.Mutex
+	nextSubID   uint64
+	subscribers map[uint64]chan Frame
+	feedback    map[uint64]ReceiverReport
+}
+
+func newStream(id string, log logrus.FieldLogger) *Stream {
+	return &Stream{
+		ID:          id,
+		log:         log.WithField("stream", id),
+		subscribers: make(map[uint64]chan Frame),
+		feedback:    make(map[uint64]ReceiverReport),
+	}
+}
+
+// Subscribe registers a new consumer on the stream. The returned channel is
+// buffered; a slow consumer has frames dropped by Publish rather than
+// blocking the publisher.
+func (s *Stream) Subscribe() *Subscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextSubID
+	s.nextSubID++
+	frames := make(chan Frame, 10)
+	s.subscribers[id] = frames
+	connectedClients.WithLabelValues(s.ID).Inc()
+
+	return &Subscriber{ID: id, Frames: frames, stream: s}
+}
+
+func (s *Stream) unsubscribe(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch, ok := s.subscribers[id]; ok {
+		close(ch)
+		delete(s.subscribers, id)
+		connectedClients.WithLabelValues(s.ID).Dec()
+	}
+	delete(s.feedback, id)
+}
+
+func (s *Stream) recordFeedback(id uint64, report ReceiverReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.feedback[id] = report
+}
+
+// WorstFeedback aggregates the latest receiver report from every
+// subscriber into a single worst-case view. One encoder feeds every
+// subscriber of a stream (see setupAudio's publisher loop), so there is
+// deliberately one shared adaptation target rather than per-client bitrate:
+// we tune for whichever listener is struggling most.
+func (s *Stream) WorstFeedback() ReceiverReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var worst ReceiverReport
+	for _, r := range s.feedback {
+		if r.FractionLost > worst.FractionLost {
+			worst.FractionLost = r.FractionLost
+		}
+		if r.Jitter > worst.Jitter {
+			worst.Jitter = r.Jitter
+		}
+	}
+	return worst
+}
+
+// Publish fans frame out to every current subscriber, dropping it for any
+// subscriber whose buffer is full instead of blocking the publisher.
+func (s *Stream) Publish(frame Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ch := range s.subscribers {
+		timer := prometheus.NewTimer(channelSendLatency.WithLabelValues(s.ID))
+		select {
+		case ch <- frame:
+			framesSentTotal.WithLabelValues(s.ID).Inc()
+		default:
+			framesDroppedTotal.WithLabelValues(s.ID).Inc()
+			s.log.WithField("subscriber", id).Debug("dropped frame, subscriber too slow")
+		}
+		timer.ObserveDuration()
+	}
+}
+
+// SubscriberCount reports how many consumers are currently attached.
+func (s *Stream) SubscriberCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+// Broker owns the set of active streams, keyed by stream ID, so publishers
+// and subscribers can find each other by name instead of going through a
+// single process-wide fanout.
+type Broker struct {
+	log logrus.FieldLogger
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+}
+
+// New creates an empty Broker.
+func New(log logrus.FieldLogger) *Broker {
+	return &Broker{log: log, streams: make(map[string]*Stream)}
+}
+
+// GetOrCreateStream returns the named stream, creating it on first use.
+func (b *Broker) GetOrCreateStream(id string) *Stream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stream, ok := b.streams[id]
+	if !ok {
+		stream = newStream(id, b.log)
+		b.streams[id] = stream
+	}
+	return stream
+}
+
+// Stream looks up an existing stream without creating it, so a WHEP
+// consumer can be told "not found" instead of silently waiting on a
+// publisher that may never show up.
+func (b *Broker) Stream(id string) (*Stream, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stream, ok := b.streams[id]
+	return stream, ok
+}
+
+// RemoveStream drops a stream from the registry. It refuses while
+// subscribers are still attached, since Publish would no longer be able to
+// reach them.
+func (b *Broker) RemoveStream(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stream, ok := b.streams[id]
+	if !ok {
+		return nil
+	}
+	if n := stream.SubscriberCount(); n > 0 {
+		return fmt.Errorf("stream %q still has %d subscriber(s)", id, n)
+	}
+	delete(b.streams, id)
+	return nil
+}
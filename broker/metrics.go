@@ -0,0 +1,32 @@
+package broker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// Labeled by stream only, not by subscriber: subscriber IDs are
+	// per-connection and unbounded over the life of a server, and nothing
+	// downstream graphs per-subscriber series anyway.
+	framesSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stroma_frames_sent_total",
+		Help: "Encoded Opus frames successfully delivered to a subscriber's fanout channel.",
+	}, []string{"stream"})
+
+	framesDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stroma_frames_dropped_total",
+		Help: "Encoded Opus frames dropped because a subscriber's fanout channel was full.",
+	}, []string{"stream"})
+
+	connectedClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stroma_connected_clients",
+		Help: "Number of subscribers currently attached to a stream.",
+	}, []string{"stream"})
+
+	channelSendLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stroma_channel_send_latency_seconds",
+		Help:    "Time spent delivering one encoded frame to a subscriber's fanout channel.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"stream"})
+)
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"sync"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+var (
+	comfortFrameOnce sync.Once
+	comfortFrame     []byte
+)
+
+// comfortNoiseFrame returns a cached near-silent Opus frame. The jitter
+// buffer plays this back instead of leaving a client's decoder starved
+// when no real frame has arrived in time for a tick; a cheap stand-in for
+// a full PLC implementation, encoded once at first use rather than per
+// connection.
+func comfortNoiseFrame() []byte {
+	comfortFrameOnce.Do(func() {
+		enc, err := opus.NewEncoder(sampleRate, channelCount, opus.AppVoIP)
+		if err != nil {
+			return
+		}
+		silence := make([]int16, frameSize)
+		buf := make([]byte, 64)
+		n, err := enc.Encode(silence, buf)
+		if err != nil {
+			return
+		}
+		comfortFrame = buf[:n]
+	})
+	return comfortFrame
+}
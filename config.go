@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// iceServersEnv holds a JSON array of webrtc.ICEServer (URLs, username,
+	// credential, credentialType), e.g.
+	//   [{"urls":["turn:turn.example.com:3478"],"username":"u","credential":"p"}]
+	// so operators can add TURN servers with long-term credentials without a
+	// custom build.
+	iceServersEnv = "ICE_SERVERS"
+	nat1To1IPsEnv = "NAT_1TO1_IPS"
+	udpPortMinEnv = "UDP_PORT_MIN"
+	udpPortMaxEnv = "UDP_PORT_MAX"
+)
+
+// loadICEServers reads the ICE_SERVERS environment variable as a JSON array
+// of webrtc.ICEServer, defaulting to the public Google STUN server so local
+// development keeps working unconfigured.
+func loadICEServers(log logrus.FieldLogger) []webrtc.ICEServer {
+	raw := os.Getenv(iceServersEnv)
+	if raw == "" {
+		return []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+	}
+
+	var servers []webrtc.ICEServer
+	if err := json.Unmarshal([]byte(raw), &servers); err != nil {
+		log.WithError(err).WithField("env", iceServersEnv).Fatal("failed to parse ICE servers")
+	}
+	return servers
+}
+
+// newWebRTCAPI builds a webrtc.API with a SettingEngine tuned for running
+// behind a NAT with a fixed public IP (NAT_1TO1_IPS) and a firewall-friendly
+// UDP port range (UDP_PORT_MIN/UDP_PORT_MAX), both optional since the
+// defaults work fine for a host with a public IP of its own. It registers
+// the default codecs and interceptors itself, since building an API from a
+// bare SettingEngine (unlike webrtc.NewPeerConnection) skips both and
+// leaves every RTPSender without a negotiable codec.
+func newWebRTCAPI(log logrus.FieldLogger) *webrtc.API {
+	settingEngine := webrtc.SettingEngine{}
+
+	if ips := os.Getenv(nat1To1IPsEnv); ips != "" {
+		settingEngine.SetNAT1To1IPs(strings.Split(ips, ","), webrtc.ICECandidateTypeHost)
+	}
+
+	if min, max, ok := parsePortRange(log); ok {
+		if err := settingEngine.SetEphemeralUDPPortRange(min, max); err != nil {
+			log.WithError(err).Fatal("failed to set ephemeral UDP port range")
+		}
+	}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		log.WithError(err).Fatal("failed to register default codecs")
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		log.WithError(err).Fatal("failed to register default interceptors")
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+	)
+}
+
+func parsePortRange(log logrus.FieldLogger) (min, max uint16, ok bool) {
+	minStr, maxStr := os.Getenv(udpPortMinEnv), os.Getenv(udpPortMaxEnv)
+	if minStr == "" && maxStr == "" {
+		return 0, 0, false
+	}
+
+	minVal, err := strconv.ParseUint(minStr, 10, 16)
+	if err != nil {
+		log.WithError(err).WithField("env", udpPortMinEnv).Fatal("failed to parse UDP port range")
+	}
+	maxVal, err := strconv.ParseUint(maxStr, 10, 16)
+	if err != nil {
+		log.WithError(err).WithField("env", udpPortMaxEnv).Fatal("failed to parse UDP port range")
+	}
+	return uint16(minVal), uint16(maxVal), true
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/kalkspace/stroma-streama/broker"
+	"github.com/kalkspace/stroma-streama/jitter"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/sirupsen/logrus"
+)
+
+type ConnectionState uint64
+
+func (s *ConnectionState) Set(state ConnectionState) {
+	atomic.StoreUint64((*uint64)(s), uint64(state))
+}
+
+func (s *ConnectionState) Get() ConnectionState {
+	return ConnectionState(atomic.LoadUint64((*uint64)(s)))
+}
+
+const (
+	ConnectionStateDisconnected ConnectionState = iota
+	ConnectionStateConnected
+	ConnectionStateClosed
+)
+
+// conn tracks the PeerConnection state of a single WHEP playback
+// connection.
+type conn struct {
+	state *ConnectionState
+}
+
+// initConn wires rtcConn up to play whatever sub receives: it creates the
+// outbound audio track, runs a jitter buffer between the broker
+// subscription and the track writer (jitterCfg controls its depth and drop
+// policy, since VoIP and music streams want different tradeoffs), and
+// unsubscribes once the PeerConnection closes.
+func initConn(log logrus.FieldLogger, rtcConn *webrtc.PeerConnection, sub *broker.Subscriber, jitterCfg jitter.Config) (*conn, error) {
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: sampleRate,
+			Channels:  channelCount,
+		},
+		"audio", "pion",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create track: %w", err)
+	}
+
+	buf := jitter.New(jitterCfg, comfortNoiseFrame())
+
+	// Feed the jitter buffer from the broker as frames arrive, coalescing
+	// publisher bursts per jitterCfg.DropPolicy.
+	go func() {
+		for frame := range sub.Frames {
+			if buf.Push(frame) {
+				log.WithField("subscriber", sub.ID).Warn("client lagging, closing connection")
+				if err := rtcConn.Close(); err != nil {
+					log.WithError(err).Warn("failed to close lagging connection")
+				}
+				return
+			}
+		}
+	}()
+
+	state := new(ConnectionState)
+	c := &conn{state: state}
+
+	// Drain the jitter buffer on a steady cadence so the track keeps
+	// receiving samples even when the publisher falls behind, falling back
+	// to a comfort-noise frame instead of leaving a gap.
+	go func() {
+		ticker := time.NewTicker(frameDuration)
+		defer ticker.Stop()
+		for range ticker.C {
+			if state.Get() == ConnectionStateClosed {
+				return
+			}
+			frame, _ := buf.Pop()
+			if buf.Lagging() {
+				log.WithField("subscriber", sub.ID).Warn("client lagging, closing connection")
+				if err := rtcConn.Close(); err != nil {
+					log.WithError(err).Warn("failed to close lagging connection")
+				}
+				return
+			}
+			if frame == nil {
+				continue
+			}
+			if err := audioTrack.WriteSample(media.Sample{Data: frame, Duration: frameDuration}); err != nil {
+				log.WithError(err).Error("failed to write sample")
+			}
+		}
+	}()
+
+	rtcConn.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		switch pcs {
+		case webrtc.PeerConnectionStateConnected:
+			state.Set(ConnectionStateConnected)
+		case webrtc.PeerConnectionStateDisconnected:
+			state.Set(ConnectionStateDisconnected)
+		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
+			state.Set(ConnectionStateClosed)
+			sub.Unsubscribe()
+		}
+	})
+
+	rtpSender, err := rtcConn.AddTrack(audioTrack)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add track: %w", err)
+	}
+
+	// Read incoming RTCP packets
+	// Before these packets are returned they are processed by interceptors. For things
+	// like NACK this needs to be called. We also parse Receiver Reports out of
+	// the stream so the publisher's encoder can adapt to this subscriber's
+	// reported loss and jitter; see broker.Stream.WorstFeedback.
+	go func() {
+		rtcpBuf := make([]byte, 1500)
+		for {
+			n, _, rtcpErr := rtpSender.Read(rtcpBuf)
+			if rtcpErr != nil {
+				log.Debug("rtcp done")
+				return
+			}
+
+			packets, err := rtcp.Unmarshal(rtcpBuf[:n])
+			if err != nil {
+				continue
+			}
+			for _, packet := range packets {
+				rr, ok := packet.(*rtcp.ReceiverReport)
+				if !ok || len(rr.Reports) == 0 {
+					continue
+				}
+				report := rr.Reports[0]
+				sub.RecordFeedback(broker.ReceiverReport{
+					FractionLost: report.FractionLost,
+					Jitter:       report.Jitter,
+				})
+			}
+		}
+	}()
+
+	return c, nil
+}
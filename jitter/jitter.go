@@ -0,0 +1,130 @@
+// Package jitter provides a small per-subscriber leaky-bucket buffer that
+// sits between a broker subscription and the track writer feeding a WHEP
+// client: it coalesces publisher bursts, hands back a comfort-noise frame
+// when nothing is buffered yet for a tick, and signals the caller to give
+// up on a client that has fallen too far behind instead of drip-feeding it
+// silent gaps forever.
+package jitter
+
+import "sync"
+
+// DropPolicy controls what Push does once the buffer is already at Depth.
+type DropPolicy int
+
+const (
+	// DropNewest discards the incoming frame, keeping what's buffered.
+	// This is the previous fixed behaviour: audio already buffered plays
+	// out in order, at the cost of losing the newest frames.
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest buffered frame to make room for the
+	// incoming one, favoring recency over completeness.
+	DropOldest
+	// Close tells Push to report the subscriber as lagging as soon as the
+	// buffer is full, for callers that would rather cut a struggling
+	// client than play catch-up.
+	Close
+)
+
+// Config controls one Buffer's depth, drop policy and lag tolerance.
+// Buffer depth and drop policy are deliberately per-client: a VoIP stream
+// wants a shallow buffer and DropOldest to stay live, while a music stream
+// can tolerate a deeper buffer to ride out bursts without audible gaps.
+type Config struct {
+	// Depth is the maximum number of frames held before DropPolicy kicks
+	// in.
+	Depth int
+	// DropPolicy decides what happens to an incoming frame once Depth is
+	// reached.
+	DropPolicy DropPolicy
+	// MaxConsecutiveDrops is how many drops in a row (Push returning a
+	// drop, or consecutive empty Pops) are tolerated before the client is
+	// marked lagging. Zero disables the check.
+	MaxConsecutiveDrops int
+}
+
+// DefaultConfig matches the previous fixed behaviour: a 10-frame buffer
+// that drops the newest frame once full, with generous lag tolerance.
+func DefaultConfig() Config {
+	return Config{Depth: 10, DropPolicy: DropNewest, MaxConsecutiveDrops: 50}
+}
+
+// Buffer is a leaky-bucket jitter buffer for one subscriber. Push is called
+// by the publisher-feeding goroutine, Pop by the track writer on its own
+// steady cadence; both are safe for concurrent use.
+type Buffer struct {
+	cfg          Config
+	comfortFrame []byte
+
+	mu               sync.Mutex
+	frames           [][]byte
+	consecutiveDrops int
+	lagging          bool
+}
+
+// New creates a Buffer using cfg, falling back to comfortFrame from Pop
+// whenever nothing real has been buffered yet.
+func New(cfg Config, comfortFrame []byte) *Buffer {
+	return &Buffer{cfg: cfg, comfortFrame: comfortFrame}
+}
+
+// Push adds frame to the buffer, applying the configured drop policy if
+// it's already at Depth. It reports lagging=true once MaxConsecutiveDrops
+// has been hit (or immediately, under the Close policy), at which point
+// the caller should tear the connection down rather than keep pushing.
+func (b *Buffer) Push(frame []byte) (lagging bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.frames) < b.cfg.Depth {
+		b.frames = append(b.frames, frame)
+		b.consecutiveDrops = 0
+		return false
+	}
+
+	if b.cfg.DropPolicy == Close {
+		b.lagging = true
+		return true
+	}
+
+	if b.cfg.DropPolicy == DropOldest {
+		b.frames = append(b.frames[1:], frame)
+	}
+	// DropNewest: the incoming frame is simply discarded.
+
+	b.consecutiveDrops++
+	if b.cfg.MaxConsecutiveDrops > 0 && b.consecutiveDrops >= b.cfg.MaxConsecutiveDrops {
+		b.lagging = true
+		return true
+	}
+	return false
+}
+
+// Pop returns the oldest buffered frame, or the comfort frame if the
+// buffer is currently empty. real is false for a comfort-frame fill, and
+// counts toward MaxConsecutiveDrops the same way a dropped Push does — a
+// publisher that stalls outright (no frames arriving at all) should trip
+// Lagging just like one that bursts past the drop policy.
+func (b *Buffer) Pop() (frame []byte, real bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.frames) == 0 {
+		b.consecutiveDrops++
+		if b.cfg.MaxConsecutiveDrops > 0 && b.consecutiveDrops >= b.cfg.MaxConsecutiveDrops {
+			b.lagging = true
+		}
+		return b.comfortFrame, false
+	}
+
+	frame = b.frames[0]
+	b.frames = b.frames[1:]
+	b.consecutiveDrops = 0
+	return frame, true
+}
+
+// Lagging reports whether this buffer has tripped its lag threshold.
+func (b *Buffer) Lagging() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lagging
+}
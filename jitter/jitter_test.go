@@ -0,0 +1,139 @@
+package jitter
+
+import "testing"
+
+func TestBuffer_PushDropPolicies(t *testing.T) {
+	cases := []struct {
+		name       string
+		policy     DropPolicy
+		wantFrames [][]byte
+		wantDrop   bool
+	}{
+		{
+			name:       "DropNewest discards the incoming frame",
+			policy:     DropNewest,
+			wantFrames: [][]byte{{1}, {2}},
+			wantDrop:   false,
+		},
+		{
+			name:       "DropOldest discards the oldest buffered frame",
+			policy:     DropOldest,
+			wantFrames: [][]byte{{2}, {3}},
+			wantDrop:   false,
+		},
+		{
+			name:       "Close reports lagging immediately once full",
+			policy:     Close,
+			wantFrames: [][]byte{{1}, {2}},
+			wantDrop:   true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := New(Config{Depth: 2, DropPolicy: tc.policy}, []byte("comfort"))
+
+			if lagging := b.Push([]byte{1}); lagging {
+				t.Fatalf("Push below depth reported lagging")
+			}
+			if lagging := b.Push([]byte{2}); lagging {
+				t.Fatalf("Push filling depth reported lagging")
+			}
+
+			lagging := b.Push([]byte{3})
+			if lagging != tc.wantDrop {
+				t.Fatalf("Push past depth: lagging = %v, want %v", lagging, tc.wantDrop)
+			}
+
+			for i, want := range tc.wantFrames {
+				frame, _ := b.Pop()
+				if string(frame) != string(want) {
+					t.Fatalf("frame %d = %v, want %v", i, frame, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuffer_PushDropNewestTripsLaggingAtMaxConsecutiveDrops(t *testing.T) {
+	b := New(Config{Depth: 1, DropPolicy: DropNewest, MaxConsecutiveDrops: 3}, []byte("comfort"))
+
+	b.Push([]byte{1}) // fills the buffer
+
+	for i := 0; i < 2; i++ {
+		if lagging := b.Push([]byte{2}); lagging {
+			t.Fatalf("Push %d tripped lagging early", i)
+		}
+	}
+	if lagging := b.Push([]byte{2}); !lagging {
+		t.Fatal("Push did not trip lagging at MaxConsecutiveDrops")
+	}
+	if !b.Lagging() {
+		t.Fatal("Lagging() false after threshold reached")
+	}
+}
+
+func TestBuffer_PopReturnsComfortFrameWhenEmpty(t *testing.T) {
+	b := New(DefaultConfig(), []byte("comfort"))
+
+	frame, real := b.Pop()
+	if real {
+		t.Fatal("Pop on empty buffer reported real=true")
+	}
+	if string(frame) != "comfort" {
+		t.Fatalf("frame = %q, want comfort frame", frame)
+	}
+}
+
+func TestBuffer_PopReturnsRealFrameAndResetsDropStreak(t *testing.T) {
+	b := New(Config{Depth: 10, MaxConsecutiveDrops: 2}, []byte("comfort"))
+
+	b.Pop() // one empty Pop, counts toward the streak
+
+	b.Push([]byte{1})
+	frame, real := b.Pop()
+	if !real {
+		t.Fatal("Pop of a pushed frame reported real=false")
+	}
+	if string(frame) != string([]byte{1}) {
+		t.Fatalf("frame = %v, want [1]", frame)
+	}
+
+	// The streak, reset by the Push and again by the real Pop above, means a
+	// second empty Pop alone shouldn't trip lagging at MaxConsecutiveDrops=2.
+	b.Pop()
+	if b.Lagging() {
+		t.Fatal("Lagging tripped despite the drop streak having been reset")
+	}
+}
+
+func TestBuffer_PopTripsLaggingAfterConsecutiveEmptyPops(t *testing.T) {
+	b := New(Config{Depth: 10, MaxConsecutiveDrops: 3}, []byte("comfort"))
+
+	for i := 0; i < 2; i++ {
+		b.Pop()
+		if b.Lagging() {
+			t.Fatalf("Lagging tripped early on empty Pop %d", i)
+		}
+	}
+
+	b.Pop()
+	if !b.Lagging() {
+		t.Fatal("Lagging not tripped after MaxConsecutiveDrops consecutive empty Pops")
+	}
+}
+
+func TestBuffer_ZeroMaxConsecutiveDropsDisablesLagging(t *testing.T) {
+	b := New(Config{Depth: 1, DropPolicy: DropNewest}, []byte("comfort"))
+
+	b.Push([]byte{0}) // fills the buffer so every subsequent Push drops
+	for i := 0; i < 100; i++ {
+		b.Push([]byte{byte(i)})
+	}
+	for i := 0; i < 100; i++ {
+		b.Pop()
+	}
+	if b.Lagging() {
+		t.Fatal("Lagging tripped despite MaxConsecutiveDrops disabled")
+	}
+}
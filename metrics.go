@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	opusBitrateBps = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stroma_opus_bitrate_bps",
+		Help: "Current Opus encoder target bitrate for a stream, in bits per second.",
+	}, []string{"stream"})
+
+	encoderFrameSizeBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stroma_encoder_frame_size_bytes",
+		Help: "Size of the most recently encoded Opus frame for a stream, in bytes.",
+	}, []string{"stream"})
+
+	encodeLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stroma_encode_latency_seconds",
+		Help:    "Time spent encoding one Opus frame.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"stream"})
+)
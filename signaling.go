@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kalkspace/stroma-streama/broker"
+	"github.com/kalkspace/stroma-streama/jitter"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// session is a resource handed out by POST on a WHIP or WHEP endpoint: its
+// id addresses it for PATCH (trickle ICE) and DELETE (teardown).
+type session struct {
+	id      string
+	rtcConn *webrtc.PeerConnection
+}
+
+// sessionStore is a concurrency-safe registry of in-flight WHIP/WHEP
+// sessions, keyed by the resource id embedded in their Location URL.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session)}
+}
+
+func (s *sessionStore) add(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess.id] = sess
+}
+
+func (s *sessionStore) get(id string) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	return sess, ok
+}
+
+func (s *sessionStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// bearerAuth wraps next, rejecting requests that don't carry a matching
+// `Authorization: Bearer <token>` header. It gates both WHIP and WHEP
+// endpoints against the same token. An empty token disables the check,
+// which is the default so local development keeps working unauthenticated.
+func bearerAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// iceLinkHeaders renders the configured ICE servers as WHIP/WHEP `Link:`
+// header values so clients can discover STUN/TURN servers from the
+// signaling response instead of hardcoding them.
+func iceLinkHeaders(servers []webrtc.ICEServer) []string {
+	links := make([]string, 0, len(servers))
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+			if server.Username != "" {
+				link += fmt.Sprintf(`; username="%s"; credential="%v"; credential-type="password"`, server.Username, server.Credential)
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// resolveAnswer drives a freshly created PeerConnection through
+// SetRemoteDescription/CreateAnswer/SetLocalDescription for an SDP offer
+// body, blocking until ICE gathering completes, and returns the answer SDP.
+func resolveAnswer(rtcConn *webrtc.PeerConnection, offerSDP string) (string, error) {
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}
+	if err := rtcConn.SetRemoteDescription(offer); err != nil {
+		return "", fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	answer, err := rtcConn.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(rtcConn)
+	if err := rtcConn.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set local description: %w", err)
+	}
+	// Block until ICE gathering completes so the initial answer is already
+	// usable for clients that don't trickle; PATCH on the resource still
+	// lets trickling clients add candidates afterwards.
+	<-gatherComplete
+
+	return rtcConn.LocalDescription().SDP, nil
+}
+
+// patchTrickleICE applies the `a=candidate` lines of a PATCH body (an
+// sdpfrag per the WHIP/WHEP trickle-ICE extension) to rtcConn.
+func patchTrickleICE(rtcConn *webrtc.PeerConnection, body string) error {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=candidate") {
+			continue
+		}
+		candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+		if err := rtcConn.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIdleStream reaps streamID from b once its WHIP publisher is gone,
+// so an unauthenticated client can't grow Broker.streams without bound by
+// POSTing new stream IDs and walking away. It's a no-op (logged at debug)
+// if subscribers are still attached, since RemoveStream refuses those.
+func removeIdleStream(log logrus.FieldLogger, b *broker.Broker, streamID string) {
+	if err := b.RemoveStream(streamID); err != nil {
+		log.WithField("stream", streamID).WithError(err).Debug("leaving stream registered, subscribers still attached")
+	}
+}
+
+// handleResource serves PATCH (trickle ICE) and DELETE (teardown) for a
+// session resource previously created by a WHIP or WHEP POST, addressed as
+// pathPrefix+{id}.
+func handleResource(log logrus.FieldLogger, store *sessionStore, pathPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, pathPrefix)
+		sess, ok := store.get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPatch:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := patchTrickleICE(sess.rtcConn, string(body)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			store.remove(id)
+			if err := sess.rtcConn.Close(); err != nil {
+				log.WithError(err).Warn("failed to close peer connection on teardown")
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// parseJitterConfig builds a per-client jitter.Config from the WHEP
+// request's query string, so a VoIP client and a music client subscribing
+// to the same stream can each pick a buffer depth and drop policy that
+// suits their tradeoffs:
+//
+//	?buffer_depth=20&drop_policy=drop-oldest
+//
+// Unset or unrecognized values fall back to jitter.DefaultConfig().
+func parseJitterConfig(r *http.Request) jitter.Config {
+	cfg := jitter.DefaultConfig()
+
+	if depth := r.URL.Query().Get("buffer_depth"); depth != "" {
+		if n, err := strconv.Atoi(depth); err == nil && n > 0 {
+			cfg.Depth = n
+		}
+	}
+
+	switch r.URL.Query().Get("drop_policy") {
+	case "drop-oldest":
+		cfg.DropPolicy = jitter.DropOldest
+	case "drop-newest":
+		cfg.DropPolicy = jitter.DropNewest
+	case "close":
+		cfg.DropPolicy = jitter.Close
+	}
+
+	return cfg
+}
+
+// handleWHEP implements a WHEP (WebRTC-HTTP Egress Protocol) endpoint:
+// POST /whep/{streamID} with an SDP offer subscribes to that stream and
+// returns a 201 Created with a Location resource URL and an Opus SDP
+// answer; PATCH/DELETE on the resource trickle ICE or tear the session
+// down.
+func handleWHEP(log logrus.FieldLogger, b *broker.Broker, store *sessionStore, authToken string) http.HandlerFunc {
+	create := bearerAuth(authToken, func(w http.ResponseWriter, r *http.Request) {
+		streamID := strings.TrimPrefix(r.URL.Path, "/whep/")
+		if streamID == "" || strings.Contains(streamID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		stream, ok := b.Stream(streamID)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+			return
+		}
+		log.WithField("stream", streamID).Debug("got WHEP offer")
+
+		rtcConn, err := rtcAPI.NewPeerConnection(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sub := stream.Subscribe()
+		if _, err := initConn(log, rtcConn, sub, parseJitterConfig(r)); err != nil {
+			sub.Unsubscribe()
+			_ = rtcConn.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		answerSDP, err := resolveAnswer(rtcConn, string(body))
+		if err != nil {
+			sub.Unsubscribe()
+			_ = rtcConn.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		id, err := newSessionID()
+		if err != nil {
+			sub.Unsubscribe()
+			_ = rtcConn.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		store.add(&session{id: id, rtcConn: rtcConn})
+
+		for _, link := range iceLinkHeaders(config.ICEServers) {
+			w.Header().Add("Link", link)
+		}
+		w.Header().Set("Location", "/whep/resource/"+id)
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(answerSDP))
+		log.WithFields(logrus.Fields{"stream": streamID, "session": id}).Debug("WHEP session created")
+	})
+
+	resource := bearerAuth(authToken, handleResource(log, store, "/whep/resource/"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/whep/resource/") {
+			resource(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			create(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// handleWHIP implements a WHIP (WebRTC-HTTP Ingest Protocol) endpoint:
+// POST /whip/{streamID} with an SDP offer registers a publisher for that
+// stream. Incoming Opus RTP packets are unwrapped and published onto the
+// broker stream so any number of WHEP subscribers can consume them.
+func handleWHIP(log logrus.FieldLogger, b *broker.Broker, store *sessionStore, authToken string) http.HandlerFunc {
+	create := bearerAuth(authToken, func(w http.ResponseWriter, r *http.Request) {
+		streamID := strings.TrimPrefix(r.URL.Path, "/whip/")
+		if streamID == "" || strings.Contains(streamID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if streamID == localStreamID {
+			http.Error(w, "stream ID is reserved for the local input device", http.StatusConflict)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+			return
+		}
+		log.WithField("stream", streamID).Debug("got WHIP offer")
+
+		rtcConn, err := rtcAPI.NewPeerConnection(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		stream := b.GetOrCreateStream(streamID)
+		if _, err := rtcConn.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			_ = rtcConn.Close()
+			removeIdleStream(log, b, streamID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rtcConn.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			for {
+				packet, _, err := track.ReadRTP()
+				if err != nil {
+					log.WithField("stream", streamID).Debug("WHIP publisher track done")
+					removeIdleStream(log, b, streamID)
+					return
+				}
+				stream.Publish(packet.Payload)
+			}
+		})
+
+		answerSDP, err := resolveAnswer(rtcConn, string(body))
+		if err != nil {
+			_ = rtcConn.Close()
+			removeIdleStream(log, b, streamID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		id, err := newSessionID()
+		if err != nil {
+			_ = rtcConn.Close()
+			removeIdleStream(log, b, streamID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		store.add(&session{id: id, rtcConn: rtcConn})
+
+		for _, link := range iceLinkHeaders(config.ICEServers) {
+			w.Header().Add("Link", link)
+		}
+		w.Header().Set("Location", "/whip/resource/"+id)
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(answerSDP))
+		log.WithFields(logrus.Fields{"stream": streamID, "session": id}).Debug("WHIP session created")
+	})
+
+	resource := bearerAuth(authToken, handleResource(log, store, "/whip/resource/"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/whip/resource/") {
+			resource(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			create(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}